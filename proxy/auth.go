@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/nadoo/glider/log"
+)
+
+// Authenticator verifies a user/password pair presented by a client before a
+// tcp:// or tls:// listener hands the connection off to Proxy.Dial.
+type Authenticator interface {
+	Authenticate(user, pass string) bool
+}
+
+// NewAuthenticator builds an Authenticator from a "kind:params" spec, as
+// used in a listener's ?auth= query value, e.g. "static:user:pass" or
+// "basic-file:/etc/glider/htpasswd".
+func NewAuthenticator(spec string) (Authenticator, error) {
+	kind, params, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("proxy: invalid auth spec: %s", spec)
+	}
+
+	switch kind {
+	case "static":
+		user, pass, ok := strings.Cut(params, ":")
+		if !ok {
+			return nil, fmt.Errorf("proxy: invalid static auth spec: %s", spec)
+		}
+		return &staticAuth{user: user, pass: pass}, nil
+	case "basic-file":
+		return newHtpasswdAuth(params)
+	default:
+		return nil, fmt.Errorf("proxy: unknown auth kind: %s", kind)
+	}
+}
+
+// Handshake performs the auth handshake used by tcp:// and tls:// listeners:
+// a 2-byte big-endian length prefix followed by a NUL-separated
+// "user\x00pass" frame, checked against auth.
+func Handshake(auth Authenticator, c net.Conn) (bool, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+		return false, fmt.Errorf("proxy: read auth frame length: %w", err)
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(c, frame); err != nil {
+		return false, fmt.Errorf("proxy: read auth frame: %w", err)
+	}
+
+	user, pass, ok := bytes.Cut(frame, []byte{0})
+	if !ok {
+		return false, errors.New("proxy: invalid auth frame")
+	}
+
+	return auth.Authenticate(string(user), string(pass)), nil
+}
+
+// staticAuth checks against a single fixed user/password pair.
+type staticAuth struct {
+	user, pass string
+}
+
+func (a *staticAuth) Authenticate(user, pass string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.pass)) == 1
+	return userOK && passOK
+}
+
+// htpasswdAuth is a bcrypt/htpasswd-backed Authenticator that watches its
+// file for changes so credentials can rotate without a glider restart.
+type htpasswdAuth struct {
+	path string
+
+	mu    sync.RWMutex
+	creds map[string]string // user -> bcrypt hash
+}
+
+func newHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	ha := &htpasswdAuth{path: path}
+	if err := ha.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("proxy: create htpasswd watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("proxy: watch htpasswd dir: %w", err)
+	}
+
+	go ha.watch(watcher)
+
+	return ha, nil
+}
+
+func (ha *htpasswdAuth) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != ha.path {
+				continue
+			}
+			if err := ha.reload(); err != nil {
+				log.F("[auth] failed to reload %s: %v", ha.path, err)
+			} else {
+				log.F("[auth] reloaded %s", ha.path)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.F("[auth] htpasswd watcher error: %v", err)
+		}
+	}
+}
+
+func (ha *htpasswdAuth) reload() error {
+	data, err := os.ReadFile(ha.path)
+	if err != nil {
+		return fmt.Errorf("proxy: read htpasswd file %s: %w", ha.path, err)
+	}
+
+	creds := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			log.F("[auth] skipping invalid htpasswd line: %s", line)
+			continue
+		}
+		creds[user] = hash
+	}
+
+	ha.mu.Lock()
+	ha.creds = creds
+	ha.mu.Unlock()
+
+	return nil
+}
+
+// Authenticate implements Authenticator.
+func (ha *htpasswdAuth) Authenticate(user, pass string) bool {
+	ha.mu.RLock()
+	hash, ok := ha.creds[user]
+	ha.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
@@ -0,0 +1,235 @@
+// Package proxyproto implements the HAProxy PROXY protocol (v1 and v2),
+// used to carry the real client address across a TCP/TLS hop that would
+// otherwise hide it behind glider's own source address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Sig is the fixed 12-byte signature at the start of every v2 header.
+var v2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	v2CmdProxy  = 0x21
+	v2FamTCP4   = 0x11
+	v2FamTCP6   = 0x21
+	maxV1Header = 107 // per spec, a v1 header never exceeds 107 bytes
+)
+
+// ReadHeader reads a PROXY protocol v1 or v2 header from conn, returning the
+// original src/dst addresses it carries. rest holds any bytes already read
+// past the header (the start of the real payload) that the caller must
+// replay before reading more from conn, since detecting the header version
+// requires buffered reads ahead of the wire.
+func ReadHeader(conn net.Conn) (src, dst net.Addr, rest []byte, err error) {
+	br := bufio.NewReaderSize(conn, maxV1Header)
+
+	sig, err := br.Peek(len(v2Sig))
+	if err == nil && bytes.Equal(sig, v2Sig) {
+		src, dst, err = readV2(br)
+	} else {
+		src, dst, err = readV1(br)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if n := br.Buffered(); n > 0 {
+		rest = make([]byte, n)
+		if _, err = io.ReadFull(br, rest); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return src, dst, rest, nil
+}
+
+func readV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	// ReadSlice, not ReadString: ReadString keeps appending past a full
+	// buffer instead of stopping at it, so a client that never sends '\n'
+	// could force unbounded buffering. ReadSlice is bounded by br's size
+	// (maxV1Header) and reports ErrBufferFull instead of growing.
+	raw, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, nil, fmt.Errorf("proxyproto: v1 header exceeds %d bytes", maxV1Header)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxyproto: read v1 header: %w", err)
+	}
+	line := strings.TrimRight(string(raw), "\r\n")
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, fmt.Errorf("proxyproto: invalid v1 header: %q", line)
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("proxyproto: invalid v1 header: %q", line)
+	}
+
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxyproto: invalid v1 src port: %q", fields[4])
+	}
+	dstPort, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxyproto: invalid v1 dst port: %q", fields[5])
+	}
+
+	src = &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: srcPort}
+	dst = &net.TCPAddr{IP: net.ParseIP(fields[3]), Port: dstPort}
+	return src, dst, nil
+}
+
+func readV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err = io.ReadFull(br, hdr); err != nil {
+		return nil, nil, fmt.Errorf("proxyproto: read v2 header: %w", err)
+	}
+
+	ver, cmd := hdr[12]>>4, hdr[12]&0x0f
+	if ver != 2 {
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v2 version: %d", ver)
+	}
+
+	fam := hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:16])
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("proxyproto: read v2 address block: %w", err)
+	}
+
+	// LOCAL command: connection was not proxied, there's no address to extract.
+	if cmd&0x0f == 0x00 {
+		return nil, nil, nil
+	}
+
+	switch fam {
+	case v2FamTCP4:
+		if len(body) < 12 {
+			return nil, nil, fmt.Errorf("proxyproto: short v2 TCP4 address block")
+		}
+		src = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case v2FamTCP6:
+		if len(body) < 36 {
+			return nil, nil, fmt.Errorf("proxyproto: short v2 TCP6 address block")
+		}
+		src = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	default:
+		return nil, nil, fmt.Errorf("proxyproto: unsupported v2 address family: 0x%x", fam)
+	}
+
+	return src, dst, nil
+}
+
+// WriteHeader writes a PROXY protocol header describing src and dst to w,
+// using the v1 text format when version is 1 and the v2 binary format
+// otherwise.
+func WriteHeader(w io.Writer, src, dst net.Addr, version int) error {
+	if version == 1 {
+		return writeV1(w, src, dst)
+	}
+	return writeV2(w, src, dst)
+}
+
+func writeV1(w io.Writer, src, dst net.Addr) error {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+
+	proto := "TCP4"
+	if srcTCP.IP.To4() == nil {
+		proto = "TCP6"
+	}
+
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcTCP.IP.String(), dstTCP.IP.String(), srcTCP.Port, dstTCP.Port)
+	return err
+}
+
+func writeV2(w io.Writer, src, dst net.Addr) error {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		hdr := append(append([]byte{}, v2Sig...), 0x20, 0x00, 0x00, 0x00)
+		_, err := w.Write(hdr)
+		return err
+	}
+
+	var body []byte
+	fam := byte(v2FamTCP4)
+	if ip4 := srcTCP.IP.To4(); ip4 != nil {
+		body = append(body, ip4...)
+		body = append(body, dstTCP.IP.To4()...)
+	} else {
+		fam = v2FamTCP6
+		body = append(body, srcTCP.IP.To16()...)
+		body = append(body, dstTCP.IP.To16()...)
+	}
+
+	port := make([]byte, 4)
+	binary.BigEndian.PutUint16(port[0:2], uint16(srcTCP.Port))
+	binary.BigEndian.PutUint16(port[2:4], uint16(dstTCP.Port))
+	body = append(body, port...)
+
+	hdr := append([]byte{}, v2Sig...)
+	hdr = append(hdr, v2CmdProxy, fam)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(body)))
+	hdr = append(hdr, length...)
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// Conn wraps a net.Conn whose PROXY protocol header has already been
+// consumed, replaying any buffered payload bytes first and reporting the
+// proxied peer's real address instead of the immediate one.
+type Conn struct {
+	net.Conn
+	rest *bytes.Reader
+	src  net.Addr
+}
+
+// NewConn returns conn wrapped so Read replays rest before falling back to
+// conn, and RemoteAddr reports src.
+func NewConn(conn net.Conn, src net.Addr, rest []byte) *Conn {
+	return &Conn{Conn: conn, rest: bytes.NewReader(rest), src: src}
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.rest.Len() > 0 {
+		return c.rest.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr implements net.Conn, returning the address carried by the
+// PROXY protocol header rather than the immediate peer's.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,157 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+func pipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	srvCh := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		srvCh <- c
+	}()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	return client, <-srvCh
+}
+
+func TestReadWriteHeaderV1(t *testing.T) {
+	client, server := pipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1111}
+	dst := &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 2222}
+
+	go func() {
+		if err := WriteHeader(client, src, dst, 1); err != nil {
+			t.Errorf("WriteHeader: %v", err)
+		}
+		client.Write([]byte("payload"))
+	}()
+
+	gotSrc, gotDst, rest, err := ReadHeader(server)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if gotSrc.String() != src.String() || gotDst.String() != dst.String() {
+		t.Fatalf("got src=%v dst=%v, want src=%v dst=%v", gotSrc, gotDst, src, dst)
+	}
+
+	buf := make([]byte, len("payload"))
+	n := copy(buf, rest)
+	if n < len(buf) {
+		if _, err := io.ReadFull(server, buf[n:]); err != nil {
+			t.Fatalf("read payload: %v", err)
+		}
+	}
+	if string(buf) != "payload" {
+		t.Fatalf("got payload %q, want %q", buf, "payload")
+	}
+}
+
+func TestReadWriteHeaderV2(t *testing.T) {
+	client, server := pipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4444}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8080}
+
+	go func() {
+		if err := WriteHeader(client, src, dst, 2); err != nil {
+			t.Errorf("WriteHeader: %v", err)
+		}
+		client.Write([]byte("payload"))
+	}()
+
+	gotSrc, gotDst, rest, err := ReadHeader(server)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if gotSrc.String() != src.String() || gotDst.String() != dst.String() {
+		t.Fatalf("got src=%v dst=%v, want src=%v dst=%v", gotSrc, gotDst, src, dst)
+	}
+
+	buf := make([]byte, len("payload"))
+	n := copy(buf, rest)
+	if n < len(buf) {
+		if _, err := io.ReadFull(server, buf[n:]); err != nil {
+			t.Fatalf("read payload: %v", err)
+		}
+	}
+	if string(buf) != "payload" {
+		t.Fatalf("got payload %q, want %q", buf, "payload")
+	}
+}
+
+func TestReadHeaderV1Unknown(t *testing.T) {
+	client, server := pipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		io.WriteString(client, "PROXY UNKNOWN\r\n")
+		client.Write([]byte("payload"))
+	}()
+
+	src, dst, rest, err := ReadHeader(server)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if src != nil || dst != nil {
+		t.Fatalf("got src=%v dst=%v, want nil/nil", src, dst)
+	}
+
+	// Bytes following the header in the same segment must still be
+	// recoverable from rest, even though there's no address to report.
+	r := bufio.NewReader(server)
+	buf := make([]byte, len("payload"))
+	n := copy(buf, rest)
+	if n < len(buf) {
+		if _, err := io.ReadFull(r, buf[n:]); err != nil {
+			t.Fatalf("read payload: %v", err)
+		}
+	}
+	if string(buf) != "payload" {
+		t.Fatalf("got payload %q, want %q", buf, "payload")
+	}
+}
+
+func TestConnReplaysRestAndReportsSrc(t *testing.T) {
+	_, server := pipe(t)
+	defer server.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("9.9.9.9"), Port: 9}
+	c := NewConn(server, src, []byte("buffered"))
+
+	if c.RemoteAddr().String() != src.String() {
+		t.Fatalf("got RemoteAddr %v, want %v", c.RemoteAddr(), src)
+	}
+
+	buf := make([]byte, len("buffered"))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != "buffered" {
+		t.Fatalf("got %q, want %q", buf, "buffered")
+	}
+}
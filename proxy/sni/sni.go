@@ -0,0 +1,360 @@
+// Package sni implements a TLS pass-through listener that routes connections
+// by the SNI name in the ClientHello, without terminating TLS and without
+// holding any server certificate.
+package sni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nadoo/glider/log"
+	"github.com/nadoo/glider/proxy"
+)
+
+// SNI struct.
+type SNI struct {
+	addr  string
+	proxy proxy.Proxy
+	rules []rule
+}
+
+// rule maps a SNI pattern ("*.example.com", an exact name, or "default") to
+// an ordered list of backend dialers to try.
+type rule struct {
+	pattern string
+	dialers []proxy.Dialer
+}
+
+func init() {
+	proxy.RegisterServer("sni", NewSNIServer)
+}
+
+// NewSNI returns a sni struct.
+func NewSNI(s string, p proxy.Proxy) (*SNI, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		log.F("[sni] parse url err: %s", err)
+		return nil, err
+	}
+
+	sn := &SNI{proxy: p, addr: u.Host}
+
+	if rulesFile := u.Query().Get("rules"); rulesFile != "" {
+		if sn.rules, err = loadRules(rulesFile, p); err != nil {
+			return nil, err
+		}
+	}
+
+	return sn, nil
+}
+
+// NewSNIServer returns a sni transport layer before the real server.
+func NewSNIServer(s string, p proxy.Proxy) (proxy.Server, error) {
+	return NewSNI(s, p)
+}
+
+// loadRules parses a rules file of "pattern=forwarder1,forwarder2" lines,
+// one rule per line, blank lines and lines starting with '#' ignored. Each
+// forwarder is a dialer URL (e.g. "tcp://1.2.3.4:443") resolved through
+// glider's own dialer machinery, so backend hops get the same health
+// tracking, TLS/SOCKS support, etc. as any other forwarder in the chain.
+func loadRules(path string, p proxy.Proxy) ([]rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[sni] read rules file %s: %w", path, err)
+	}
+
+	var rules []rule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			log.F("[sni] skipping invalid rule line: %s", line)
+			continue
+		}
+
+		var dialers []proxy.Dialer
+		for _, fwd := range strings.Split(strings.TrimSpace(kv[1]), ",") {
+			d, err := proxy.DialerFromURL(strings.TrimSpace(fwd), nil)
+			if err != nil {
+				return nil, fmt.Errorf("[sni] parse forwarder %q: %w", fwd, err)
+			}
+			dialers = append(dialers, d)
+		}
+
+		rules = append(rules, rule{
+			pattern: strings.TrimSpace(kv[0]),
+			dialers: dialers,
+		})
+	}
+
+	return rules, nil
+}
+
+// match returns the rule for sniName, preferring an exact match over a
+// "*." wildcard suffix match, and falling back to the "default" rule.
+func (sn *SNI) match(sniName string) *rule {
+	var def, wildcard *rule
+	for i := range sn.rules {
+		r := &sn.rules[i]
+		switch {
+		case r.pattern == sniName:
+			return r
+		case r.pattern == "default":
+			def = r
+		case strings.HasPrefix(r.pattern, "*.") && strings.HasSuffix(sniName, r.pattern[1:]):
+			wildcard = r
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return def
+}
+
+// ListenAndServe listens on server's addr and serves connections.
+func (sn *SNI) ListenAndServe() {
+	l, err := net.Listen("tcp", sn.addr)
+	if err != nil {
+		log.F("[sni] failed to listen on %s: %v", sn.addr, err)
+		return
+	}
+	defer l.Close()
+
+	log.F("[sni] listening TCP on %s", sn.addr)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.F("[sni] failed to accept: %v", err)
+			continue
+		}
+
+		go sn.Serve(c)
+	}
+}
+
+// Serve peeks the SNI name out of the ClientHello on c, picks a backend by
+// matching it against the rule table, and relays the raw byte stream
+// (ClientHello included) to that backend.
+func (sn *SNI) Serve(c net.Conn) {
+	defer c.Close()
+
+	name, buffered, err := peekClientHelloSNI(c)
+	if err != nil {
+		log.F("[sni] %s failed to read ClientHello: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	bc := newBufferedConn(c, buffered)
+
+	var dialers []proxy.Dialer
+	if r := sn.match(name); r != nil && len(r.dialers) > 0 {
+		dialers = r.dialers
+	} else {
+		dialers = []proxy.Dialer{sn.proxy.NextDialer(name)}
+	}
+
+	var rc net.Conn
+	var dialer proxy.Dialer
+	for _, d := range dialers {
+		if rc, err = d.Dial("tcp", name); err == nil {
+			dialer = d
+			break
+		}
+		log.F("[sni] %s <-> %s(%s), error in dial: %v", c.RemoteAddr(), d.Addr(), name, err)
+		sn.proxy.Record(d, false)
+	}
+
+	if rc == nil {
+		log.F("[sni] %s(%s), all forwarders failed", c.RemoteAddr(), name)
+		return
+	}
+	defer rc.Close()
+
+	log.F("[sni] %s <-> %s(%s)", c.RemoteAddr(), dialer.Addr(), name)
+
+	if err = proxy.Relay(bc, rc); err != nil {
+		log.F("[sni] %s <-> %s(%s), relay error: %v", c.RemoteAddr(), dialer.Addr(), name, err)
+		sn.proxy.Record(dialer, false)
+	}
+}
+
+// Addr returns server's address.
+func (sn *SNI) Addr() string {
+	return sn.addr
+}
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionServerName      = 0x0000
+)
+
+// peekClientHelloSNI reads TLS records off c until a complete ClientHello
+// has been reassembled (handling a ClientHello fragmented across several TLS
+// records), extracts its SNI server_name extension, and returns the exact
+// bytes consumed so they can be replayed verbatim to the chosen backend.
+//
+// Encrypted Client Hello (ECH) is not decrypted: such connections are routed
+// on the outer ClientHello's plaintext server_name (the public name), and the
+// inner ClientHello's SNI is never seen. A ClientHello without a server_name
+// extension yields an empty name, which only the "default" rule matches.
+func peekClientHelloSNI(c net.Conn) (name string, buffered []byte, err error) {
+	var raw bytes.Buffer
+	var hs []byte
+
+	for {
+		hdr := make([]byte, 5)
+		if _, err = io.ReadFull(c, hdr); err != nil {
+			return "", nil, err
+		}
+		raw.Write(hdr)
+
+		if hdr[0] != recordTypeHandshake {
+			return "", nil, errors.New("sni: not a TLS handshake record")
+		}
+
+		recLen := int(binary.BigEndian.Uint16(hdr[3:5]))
+		rec := make([]byte, recLen)
+		if _, err = io.ReadFull(c, rec); err != nil {
+			return "", nil, err
+		}
+		raw.Write(rec)
+		hs = append(hs, rec...)
+
+		if len(hs) < 4 {
+			continue
+		}
+		if hs[0] != handshakeTypeClientHello {
+			return "", nil, errors.New("sni: not a ClientHello")
+		}
+
+		bodyLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+		if len(hs) >= 4+bodyLen {
+			name, err = parseServerName(hs[4 : 4+bodyLen])
+			return name, raw.Bytes(), err
+		}
+		// ClientHello body spans more records than we've read so far, keep going.
+	}
+}
+
+// parseServerName extracts the host_name entry of the server_name extension
+// from a ClientHello body.
+func parseServerName(body []byte) (string, error) {
+	p := body
+
+	if len(p) < 34 { // client_version(2) + random(32)
+		return "", errors.New("sni: ClientHello too short")
+	}
+	p = p[34:]
+
+	if len(p) < 1 {
+		return "", errors.New("sni: truncated at session id")
+	}
+	sidLen := int(p[0])
+	p = p[1:]
+	if len(p) < sidLen {
+		return "", errors.New("sni: truncated at session id")
+	}
+	p = p[sidLen:]
+
+	if len(p) < 2 {
+		return "", errors.New("sni: truncated at cipher suites")
+	}
+	csLen := int(binary.BigEndian.Uint16(p[:2]))
+	p = p[2:]
+	if len(p) < csLen {
+		return "", errors.New("sni: truncated at cipher suites")
+	}
+	p = p[csLen:]
+
+	if len(p) < 1 {
+		return "", errors.New("sni: truncated at compression methods")
+	}
+	cmLen := int(p[0])
+	p = p[1:]
+	if len(p) < cmLen {
+		return "", errors.New("sni: truncated at compression methods")
+	}
+	p = p[cmLen:]
+
+	if len(p) < 2 {
+		return "", nil // no extensions present, no SNI to route on
+	}
+	extLen := int(binary.BigEndian.Uint16(p[:2]))
+	p = p[2:]
+	if len(p) < extLen {
+		return "", errors.New("sni: truncated at extensions")
+	}
+	p = p[:extLen]
+
+	for len(p) >= 4 {
+		extType := binary.BigEndian.Uint16(p[:2])
+		l := int(binary.BigEndian.Uint16(p[2:4]))
+		p = p[4:]
+		if len(p) < l {
+			return "", errors.New("sni: truncated extension body")
+		}
+		data := p[:l]
+		p = p[l:]
+
+		if extType != extensionServerName {
+			continue
+		}
+
+		if len(data) < 2 {
+			continue
+		}
+		listLen := int(binary.BigEndian.Uint16(data[:2]))
+		data = data[2:]
+		if listLen < len(data) {
+			data = data[:listLen]
+		}
+
+		for len(data) >= 3 {
+			nameType := data[0]
+			nameLen := int(binary.BigEndian.Uint16(data[1:3]))
+			data = data[3:]
+			if len(data) < nameLen {
+				break
+			}
+			if nameType == 0 { // host_name
+				return string(data[:nameLen]), nil
+			}
+			data = data[nameLen:]
+		}
+	}
+
+	return "", nil
+}
+
+// bufferedConn replays bytes already consumed while peeking the ClientHello
+// before falling back to reading from the underlying conn.
+type bufferedConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func newBufferedConn(c net.Conn, buf []byte) *bufferedConn {
+	return &bufferedConn{Conn: c, r: bytes.NewReader(buf)}
+}
+
+// Read implements net.Conn.
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	if b.r.Len() > 0 {
+		return b.r.Read(p)
+	}
+	return b.Conn.Read(p)
+}
@@ -0,0 +1,152 @@
+package sni
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func pipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	srvCh := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		srvCh <- c
+	}()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	return client, <-srvCh
+}
+
+// buildClientHello returns a ClientHello handshake message (4-byte
+// handshake header included) carrying a single server_name extension for
+// host.
+func buildClientHello(host string) []byte {
+	var body bytes.Buffer
+	body.Write(make([]byte, 2))                // client_version
+	body.Write(make([]byte, 32))               // random
+	body.WriteByte(0)                          // session_id length
+	body.Write([]byte{0x00, 0x02, 0x00, 0x2f}) // cipher_suites
+	body.Write([]byte{0x01, 0x00})             // compression_methods
+
+	var sni bytes.Buffer
+	sni.WriteByte(0) // host_name
+	nameLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(nameLen, uint16(len(host)))
+	sni.Write(nameLen)
+	sni.WriteString(host)
+
+	var sniList bytes.Buffer
+	listLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(listLen, uint16(sni.Len()))
+	sniList.Write(listLen)
+	sniList.Write(sni.Bytes())
+
+	var ext bytes.Buffer
+	ext.Write([]byte{0x00, 0x00}) // extension type: server_name
+	extBodyLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extBodyLen, uint16(sniList.Len()))
+	ext.Write(extBodyLen)
+	ext.Write(sniList.Bytes())
+
+	extTotalLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extTotalLen, uint16(ext.Len()))
+	body.Write(extTotalLen)
+	body.Write(ext.Bytes())
+
+	hsBody := body.Bytes()
+	hs := make([]byte, 4+len(hsBody))
+	hs[0] = handshakeTypeClientHello
+	hs[1] = byte(len(hsBody) >> 16)
+	hs[2] = byte(len(hsBody) >> 8)
+	hs[3] = byte(len(hsBody))
+	copy(hs[4:], hsBody)
+
+	return hs
+}
+
+// tlsRecords wraps hs in TLS handshake records of at most recSize bytes
+// each, simulating a ClientHello fragmented across several records.
+func tlsRecords(hs []byte, recSize int) []byte {
+	var out bytes.Buffer
+	for len(hs) > 0 {
+		n := recSize
+		if n > len(hs) {
+			n = len(hs)
+		}
+		out.Write([]byte{recordTypeHandshake, 0x03, 0x03})
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(n))
+		out.Write(lenBuf)
+		out.Write(hs[:n])
+		hs = hs[n:]
+	}
+	return out.Bytes()
+}
+
+func TestPeekClientHelloSNIFragmented(t *testing.T) {
+	client, server := pipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	hs := buildClientHello("example.com")
+	wire := tlsRecords(hs, 16) // force the ClientHello across several records
+	extra := []byte("payload-after-hello")
+
+	go func() {
+		client.Write(wire)
+		client.Write(extra)
+	}()
+
+	name, buffered, err := peekClientHelloSNI(server)
+	if err != nil {
+		t.Fatalf("peekClientHelloSNI: %v", err)
+	}
+	if name != "example.com" {
+		t.Fatalf("got name %q, want %q", name, "example.com")
+	}
+	if !bytes.Equal(buffered, wire) {
+		t.Fatalf("got %d buffered bytes, want the %d ClientHello wire bytes replayed verbatim", len(buffered), len(wire))
+	}
+
+	rest := make([]byte, len(extra))
+	if _, err := io.ReadFull(server, rest); err != nil {
+		t.Fatalf("read trailing payload: %v", err)
+	}
+	if !bytes.Equal(rest, extra) {
+		t.Fatalf("got trailing payload %q, want %q", rest, extra)
+	}
+}
+
+func TestParseServerNameNoExtensions(t *testing.T) {
+	var body bytes.Buffer
+	body.Write(make([]byte, 2))               // client_version
+	body.Write(make([]byte, 32))               // random
+	body.WriteByte(0)                          // session_id length
+	body.Write([]byte{0x00, 0x02, 0x00, 0x2f}) // cipher_suites
+	body.Write([]byte{0x01, 0x00})             // compression_methods
+
+	name, err := parseServerName(body.Bytes())
+	if err != nil {
+		t.Fatalf("parseServerName: %v", err)
+	}
+	if name != "" {
+		t.Fatalf("got name %q, want empty", name)
+	}
+}
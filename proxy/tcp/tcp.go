@@ -1,12 +1,15 @@
 package tcp
 
 import (
+	"fmt"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/nadoo/glider/log"
 	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/proxy/proxyproto"
 )
 
 // TCP struct.
@@ -15,6 +18,11 @@ type TCP struct {
 	dialer proxy.Dialer
 	proxy  proxy.Proxy
 	scheme string
+
+	recvProxyProto int // accept a PROXY protocol header of this version (1 or 2) on incoming conns
+	sendProxyProto int // send a PROXY protocol header of this version (1 or 2) to the dialed conn
+
+	auth proxy.Authenticator // set via ?auth=, checked before s.proxy.Dial
 }
 
 func init() {
@@ -34,6 +42,8 @@ func NewTCP(s string, d proxy.Dialer, p proxy.Proxy) (*TCP, error) {
 		return nil, err
 	}
 
+	query := u.Query()
+
 	t := &TCP{
 		dialer: d,
 		proxy:  p,
@@ -41,6 +51,24 @@ func NewTCP(s string, d proxy.Dialer, p proxy.Proxy) (*TCP, error) {
 		scheme: u.Scheme,
 	}
 
+	if v := query.Get("proxyProtocol"); v != "" {
+		if t.recvProxyProto, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("[tcp] invalid proxyProtocol value: %s", v)
+		}
+	}
+
+	if v := query.Get("sendProxyProtocol"); v != "" {
+		if t.sendProxyProto, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("[tcp] invalid sendProxyProtocol value: %s", v)
+		}
+	}
+
+	if v := query.Get("auth"); v != "" {
+		if t.auth, err = proxy.NewAuthenticator(v); err != nil {
+			return nil, err
+		}
+	}
+
 	return t, nil
 }
 
@@ -80,8 +108,27 @@ func (s *TCP) ListenAndServe() {
 func (s *TCP) Serve(c net.Conn) {
 	defer c.Close()
 
-	if c, ok := c.(*net.TCPConn); ok {
-		c.SetKeepAlive(true)
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+
+	if s.recvProxyProto > 0 {
+		src, _, rest, err := proxyproto.ReadHeader(c)
+		if err != nil {
+			log.F("[tcp] %s failed to read proxy protocol header: %v", c.RemoteAddr(), err)
+			return
+		}
+		if src != nil || len(rest) > 0 {
+			c = proxyproto.NewConn(c, src, rest)
+		}
+	}
+
+	if s.auth != nil {
+		ok, err := proxy.Handshake(s.auth, c)
+		if err != nil || !ok {
+			log.F("[tcp] %s auth failed: %v", c.RemoteAddr(), err)
+			return
+		}
 	}
 
 	rc, dialer, err := s.proxy.Dial("tcp", "")
@@ -92,6 +139,12 @@ func (s *TCP) Serve(c net.Conn) {
 	}
 	defer rc.Close()
 
+	if s.sendProxyProto > 0 {
+		if err := proxyproto.WriteHeader(rc, c.RemoteAddr(), c.LocalAddr(), s.sendProxyProto); err != nil {
+			log.F("[tcp] %s <-> %s, failed to write proxy protocol header: %v", c.RemoteAddr(), dialer.Addr(), err)
+		}
+	}
+
 	log.F("[tcp] %s <-> %s", c.RemoteAddr(), dialer.Addr())
 
 	if err = proxy.Relay(c, rc); err != nil {
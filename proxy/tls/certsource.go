@@ -0,0 +1,200 @@
+package tls
+
+import (
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/nadoo/glider/log"
+)
+
+// CertSource supplies a certificate for a TLS handshake based on the SNI
+// name the client asked for, letting NewTLSServer rotate or provision
+// certificates without a glider restart.
+type CertSource interface {
+	GetCertificate(hello *stdtls.ClientHelloInfo) (*stdtls.Certificate, error)
+}
+
+// alpnRequirer is implemented by CertSources that need an extra protocol
+// added to the server's NextProtos to complete their own handshakes, e.g.
+// ACME's TLS-ALPN-01 challenge, which is negotiated before GetCertificate
+// ever runs.
+type alpnRequirer interface {
+	requiredALPNProtocol() string
+}
+
+// newCertSource builds the CertSource selected by the server URL's
+// ?certSource= query param, or nil if certFile/keyFile should be used as-is.
+func newCertSource(query url.Values) (CertSource, error) {
+	switch query.Get("certSource") {
+	case "", "file":
+		if certDir := query.Get("certDir"); certDir != "" {
+			return newFileCertSource(certDir)
+		}
+		return nil, nil
+	case "acme":
+		return newACMECertSource(query)
+	default:
+		return nil, fmt.Errorf("[tls] unknown certSource: %s", query.Get("certSource"))
+	}
+}
+
+// fileCertSource watches a directory of <name>.crt/<name>.key pairs and
+// serves certificates keyed by each certificate's CN and SAN entries,
+// reloading whenever a pair changes on disk.
+type fileCertSource struct {
+	dir string
+
+	mu    sync.RWMutex
+	certs map[string]*stdtls.Certificate
+}
+
+func newFileCertSource(dir string) (*fileCertSource, error) {
+	fc := &fileCertSource{dir: dir}
+	if err := fc.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("[tls] create cert dir watcher: %w", err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("[tls] watch cert dir %s: %w", dir, err)
+	}
+
+	go fc.watch(watcher)
+
+	return fc, nil
+}
+
+func (fc *fileCertSource) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !strings.HasSuffix(event.Name, ".crt") && !strings.HasSuffix(event.Name, ".key") {
+				continue
+			}
+			if err := fc.reload(); err != nil {
+				log.F("[tls] failed to reload certs from %s: %v", fc.dir, err)
+			} else {
+				log.F("[tls] reloaded certs from %s", fc.dir)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.F("[tls] cert dir watcher error: %v", err)
+		}
+	}
+}
+
+func (fc *fileCertSource) reload() error {
+	entries, err := os.ReadDir(fc.dir)
+	if err != nil {
+		return fmt.Errorf("[tls] read cert dir %s: %w", fc.dir, err)
+	}
+
+	certs := make(map[string]*stdtls.Certificate)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".crt") {
+			continue
+		}
+
+		base := strings.TrimSuffix(e.Name(), ".crt")
+		certFile := filepath.Join(fc.dir, e.Name())
+		keyFile := filepath.Join(fc.dir, base+".key")
+
+		cert, err := stdtls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.F("[tls] skipping cert pair %s: %v", base, err)
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.F("[tls] skipping cert pair %s: parse leaf: %v", base, err)
+			continue
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if leaf.Subject.CommonName != "" {
+			names = append(names, leaf.Subject.CommonName)
+		}
+		for _, name := range names {
+			certs[name] = &cert
+		}
+	}
+
+	fc.mu.Lock()
+	fc.certs = certs
+	fc.mu.Unlock()
+
+	return nil
+}
+
+// GetCertificate implements CertSource.
+func (fc *fileCertSource) GetCertificate(hello *stdtls.ClientHelloInfo) (*stdtls.Certificate, error) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+
+	if cert, ok := fc.certs[hello.ServerName]; ok {
+		return cert, nil
+	}
+
+	return nil, fmt.Errorf("[tls] no certificate for %q in %s", hello.ServerName, fc.dir)
+}
+
+// acmeCertSource wraps autocert.Manager, restricted to the configured host
+// list, to obtain and renew certificates from an ACME CA on demand.
+type acmeCertSource struct {
+	mgr *autocert.Manager
+}
+
+func newACMECertSource(query url.Values) (*acmeCertSource, error) {
+	cacheDir := query.Get("acmeCache")
+	if cacheDir == "" {
+		return nil, fmt.Errorf("[tls] acmeCache must be specified for certSource=acme")
+	}
+
+	hostsParam := query.Get("acmeHosts")
+	if hostsParam == "" {
+		return nil, fmt.Errorf("[tls] acmeHosts must be specified for certSource=acme")
+	}
+	hosts := strings.Split(hostsParam, ",")
+
+	mgr := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      query.Get("acmeEmail"),
+	}
+
+	return &acmeCertSource{mgr: mgr}, nil
+}
+
+// GetCertificate implements CertSource.
+func (ac *acmeCertSource) GetCertificate(hello *stdtls.ClientHelloInfo) (*stdtls.Certificate, error) {
+	return ac.mgr.GetCertificate(hello)
+}
+
+// requiredALPNProtocol implements alpnRequirer: a TLS-ALPN-01 challenge
+// handshake only offers acme.ALPNProto, so the server must be willing to
+// negotiate it or the challenge fails before GetCertificate is called.
+func (ac *acmeCertSource) requiredALPNProtocol() string {
+	return acme.ALPNProto
+}
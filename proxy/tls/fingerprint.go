@@ -0,0 +1,71 @@
+package tls
+
+import (
+	"fmt"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+
+	"github.com/nadoo/glider/log"
+)
+
+// sharedUTLSSessionCache lets uTLS dials resume sessions across dials. It is
+// one cache for every uTLS dialer in the process, whereas the stdlib path
+// gets its own ClientSessionCache per TLS{} instance in NewTLSDialer.
+var sharedUTLSSessionCache = utls.NewLRUClientSessionCache(64)
+
+// clientHelloID maps the ?fingerprint= value to the uTLS ClientHelloID that
+// mimics that client's ClientHello.
+func clientHelloID(fingerprint string) (utls.ClientHelloID, error) {
+	switch fingerprint {
+	case "chrome":
+		return utls.HelloChrome_Auto, nil
+	case "firefox":
+		return utls.HelloFirefox_Auto, nil
+	case "safari":
+		return utls.HelloSafari_Auto, nil
+	case "ios":
+		return utls.HelloIOS_Auto, nil
+	case "random":
+		return utls.HelloRandomized, nil
+	default:
+		return utls.ClientHelloID{}, fmt.Errorf("[tls] unknown fingerprint: %s", fingerprint)
+	}
+}
+
+// dialUTLS performs the TLS handshake over cc with uTLS instead of the
+// stdlib, using the ClientHelloID selected by s.fingerprint so SNI/JA3-based
+// middleboxes see an ordinary browser handshake rather than Go's own.
+func (s *TLS) dialUTLS(cc net.Conn) (net.Conn, error) {
+	id, err := clientHelloID(s.fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &utls.Config{
+		ServerName:         s.serverName,
+		InsecureSkipVerify: s.skipVerify,
+		ClientSessionCache: sharedUTLSSessionCache,
+		NextProtos:         s.alpn,
+	}
+
+	uc := utls.UClient(cc, config, id)
+	if err := uc.Handshake(); err != nil {
+		log.F("[tls] uTLS handshake to %s error: %s", s.addr, err)
+		return nil, err
+	}
+
+	return &UConn{UConn: uc}, nil
+}
+
+// UConn wraps a *utls.UConn so it exposes the negotiated ALPN protocol the
+// same way Conn does for the stdlib path.
+type UConn struct {
+	*utls.UConn
+}
+
+// ALPN returns the protocol negotiated during the TLS handshake, or "" if
+// none was negotiated.
+func (c *UConn) ALPN() string {
+	return c.ConnectionState().NegotiatedProtocol
+}
@@ -2,13 +2,19 @@ package tls
 
 import (
 	stdtls "crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/nadoo/glider/log"
 	"github.com/nadoo/glider/proxy"
+	"github.com/nadoo/glider/proxy/proxyproto"
 )
 
 // TLS struct.
@@ -22,10 +28,22 @@ type TLS struct {
 	serverName string
 	skipVerify bool
 
-	certFile string
-	keyFile  string
+	certFile   string
+	keyFile    string
+	certSource CertSource // set when ?certSource=file|acme is used instead of cert/key
 
-	server proxy.Server
+	recvProxyProto int // accept a PROXY protocol header of this version (1 or 2) on incoming conns
+	sendProxyProto int // send a PROXY protocol header of this version (1 or 2) to the dialed conn
+
+	alpn        []string // NextProtos offered/accepted via ?alpn=h2,http/1.1,...
+	fingerprint string   // ?fingerprint=chrome|firefox|safari|ios|random|golang, dialer only
+
+	server     proxy.Server            // chain used when ALPN is unset or has no per-protocol match
+	alpnChains map[string]proxy.Server // chain selected by the negotiated ALPN protocol
+
+	auth          proxy.Authenticator // set via ?auth=basic-file:... or ?auth=static:..., checked before s.proxy.Dial
+	mtls          bool                // ?auth=mtls: require and verify a client certificate
+	clientCNAllow map[string]bool     // ?clientCNs=, non-empty restricts mtls to these CNs
 }
 
 func init() {
@@ -60,6 +78,39 @@ func NewTLS(s string, d proxy.Dialer, p proxy.Proxy) (*TLS, error) {
 		t.serverName = t.addr[:strings.LastIndex(t.addr, ":")]
 	}
 
+	if v := query.Get("proxyProtocol"); v != "" {
+		if t.recvProxyProto, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("[tls] invalid proxyProtocol value: %s", v)
+		}
+	}
+
+	if v := query.Get("sendProxyProtocol"); v != "" {
+		if t.sendProxyProto, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("[tls] invalid sendProxyProtocol value: %s", v)
+		}
+	}
+
+	if v := query.Get("alpn"); v != "" {
+		t.alpn = strings.Split(v, ",")
+	}
+
+	t.fingerprint = query.Get("fingerprint")
+
+	if auth := query.Get("auth"); auth == "mtls" {
+		t.mtls = true
+	} else if auth != "" {
+		if t.auth, err = proxy.NewAuthenticator(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := query.Get("clientCNs"); v != "" {
+		t.clientCNAllow = make(map[string]bool)
+		for _, cn := range strings.Split(v, ",") {
+			t.clientCNAllow[cn] = true
+		}
+	}
+
 	return t, nil
 }
 
@@ -75,40 +126,116 @@ func NewTLSDialer(s string, d proxy.Dialer) (proxy.Dialer, error) {
 		InsecureSkipVerify: p.skipVerify,
 		ClientSessionCache: stdtls.NewLRUClientSessionCache(64),
 		MinVersion:         stdtls.VersionTLS12,
+		NextProtos:         p.alpn,
 	}
 
 	return p, err
 }
 
+// chainSchemeRe matches the start of a chain entry, e.g. "socks5://" or
+// "trojan://".
+var chainSchemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// splitServerChain splits "tls://addr?...,chain1;chain2" into the listener's
+// own URL and the chain suffix. It looks for a comma immediately followed by
+// a schemed URL rather than just the first comma in s, since the listener's
+// own query string (e.g. ?alpn=h2,http/1.1) may itself contain commas.
+func splitServerChain(s string) (server, chain string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != ',' {
+			continue
+		}
+		if chainSchemeRe.MatchString(s[i+1:]) {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
 // NewTLSServer returns a tls transport layer before the real server.
 func NewTLSServer(s string, p proxy.Proxy) (proxy.Server, error) {
-	server, chain := s, ""
-	if idx := strings.IndexByte(s, ','); idx != -1 {
-		server, chain = s[:idx], s[idx+1:]
-	}
+	server, chain := splitServerChain(s)
 
 	t, err := NewTLS(server, nil, p)
 	if err != nil {
 		return nil, err
 	}
 
-	if t.certFile == "" || t.keyFile == "" {
-		return nil, errors.New("[tls] cert and key file path must be spcified")
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
 	}
 
-	cert, err := stdtls.LoadX509KeyPair(t.certFile, t.keyFile)
+	t.certSource, err = newCertSource(u.Query())
 	if err != nil {
-		log.F("[tls] unable to load cert: %s, key %s", t.certFile, t.keyFile)
 		return nil, err
 	}
 
 	t.config = &stdtls.Config{
-		Certificates: []stdtls.Certificate{cert},
-		MinVersion:   stdtls.VersionTLS12,
+		MinVersion: stdtls.VersionTLS12,
+		NextProtos: t.alpn,
+	}
+
+	if t.certSource != nil {
+		t.config.GetCertificate = t.certSource.GetCertificate
+		if ar, ok := t.certSource.(alpnRequirer); ok {
+			t.config.NextProtos = append(t.config.NextProtos, ar.requiredALPNProtocol())
+		}
+	} else {
+		if t.certFile == "" || t.keyFile == "" {
+			return nil, errors.New("[tls] cert and key file path must be spcified")
+		}
+
+		cert, err := stdtls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			log.F("[tls] unable to load cert: %s, key %s", t.certFile, t.keyFile)
+			return nil, err
+		}
+
+		t.config.Certificates = []stdtls.Certificate{cert}
+	}
+
+	if t.mtls {
+		caFile := u.Query().Get("clientCA")
+		if caFile == "" {
+			return nil, errors.New("[tls] clientCA must be specified for auth=mtls")
+		}
+
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("[tls] read clientCA %s: %w", caFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("[tls] no certificates found in clientCA %s", caFile)
+		}
+
+		t.config.ClientCAs = pool
+		t.config.ClientAuth = stdtls.RequireAndVerifyClientCert
 	}
 
 	if chain != "" {
-		t.server, err = proxy.ServerFromURL(chain, p)
+		chains := strings.Split(chain, ";")
+		if len(t.alpn) > 1 && len(chains) > 1 {
+			// tls://addr,proto1://...;proto2://... : the Nth chain serves the
+			// Nth negotiated protocol in ?alpn=, dispatched in TLS.Serve once
+			// the handshake reveals which protocol the client picked.
+			t.alpnChains = make(map[string]proxy.Server, len(chains))
+			for i, chainURL := range chains {
+				if i >= len(t.alpn) {
+					break
+				}
+				srv, err := proxy.ServerFromURL(chainURL, p)
+				if err != nil {
+					return nil, err
+				}
+				t.alpnChains[t.alpn[i]] = srv
+			}
+		}
+
+		// first chain also serves as the fallback for unmatched/absent ALPN.
+		t.server, err = proxy.ServerFromURL(chains[0], p)
 		if err != nil {
 			return nil, err
 		}
@@ -141,8 +268,54 @@ func (s *TLS) ListenAndServe() {
 
 // Serve serves a connection.
 func (s *TLS) Serve(cc net.Conn) {
+	if s.recvProxyProto > 0 {
+		src, _, rest, err := proxyproto.ReadHeader(cc)
+		if err != nil {
+			log.F("[tls] %s failed to read proxy protocol header: %v", cc.RemoteAddr(), err)
+			cc.Close()
+			return
+		}
+		if src != nil || len(rest) > 0 {
+			cc = proxyproto.NewConn(cc, src, rest)
+		}
+	}
+
 	c := stdtls.Server(cc, s.config)
 
+	if len(s.alpnChains) > 0 || s.mtls || s.auth != nil {
+		if err := c.Handshake(); err != nil {
+			log.F("[tls] %s handshake error: %v", cc.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+
+		if s.mtls && len(s.clientCNAllow) > 0 {
+			var cn string
+			if peers := c.ConnectionState().PeerCertificates; len(peers) > 0 {
+				cn = peers[0].Subject.CommonName
+			}
+			if !s.clientCNAllow[cn] {
+				log.F("[tls] %s rejected, client cert CN %q not allowed", cc.RemoteAddr(), cn)
+				c.Close()
+				return
+			}
+		}
+
+		if s.auth != nil {
+			ok, err := proxy.Handshake(s.auth, c)
+			if err != nil || !ok {
+				log.F("[tls] %s auth failed: %v", c.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+		}
+
+		if srv, ok := s.alpnChains[c.ConnectionState().NegotiatedProtocol]; ok {
+			srv.Serve(c)
+			return
+		}
+	}
+
 	if s.server != nil {
 		s.server.Serve(c)
 		return
@@ -158,6 +331,12 @@ func (s *TLS) Serve(cc net.Conn) {
 	}
 	defer rc.Close()
 
+	if s.sendProxyProto > 0 {
+		if err := proxyproto.WriteHeader(rc, c.RemoteAddr(), cc.LocalAddr(), s.sendProxyProto); err != nil {
+			log.F("[tls] %s <-> %s, failed to write proxy protocol header: %v", c.RemoteAddr(), dialer.Addr(), err)
+		}
+	}
+
 	log.F("[tls] %s <-> %s", c.RemoteAddr(), dialer.Addr())
 
 	if err = proxy.Relay(c, rc); err != nil {
@@ -185,12 +364,31 @@ func (s *TLS) Dial(network, addr string) (net.Conn, error) {
 		return nil, err
 	}
 
+	if s.fingerprint != "" && s.fingerprint != "golang" {
+		return s.dialUTLS(cc)
+	}
+
 	c := stdtls.Client(cc, s.config)
-	err = c.Handshake()
-	return c, err
+	if err = c.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: c}, nil
 }
 
 // DialUDP connects to the given address via the proxy.
 func (s *TLS) DialUDP(network, addr string) (net.PacketConn, net.Addr, error) {
 	return nil, nil, proxy.ErrNotSupported
 }
+
+// Conn wraps a *stdtls.Conn to expose the protocol negotiated via ALPN, so
+// upstream transports can adapt to what the server picked.
+type Conn struct {
+	*stdtls.Conn
+}
+
+// ALPN returns the protocol negotiated during the TLS handshake, or "" if
+// none was negotiated.
+func (c *Conn) ALPN() string {
+	return c.ConnectionState().NegotiatedProtocol
+}
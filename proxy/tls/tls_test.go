@@ -0,0 +1,167 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nadoo/glider/proxy"
+)
+
+func TestSplitServerChain(t *testing.T) {
+	cases := []struct {
+		in         string
+		wantServer string
+		wantChain  string
+	}{
+		{
+			in:         "tls://:443?cert=c.pem&key=k.pem",
+			wantServer: "tls://:443?cert=c.pem&key=k.pem",
+			wantChain:  "",
+		},
+		{
+			in:         "tls://:443,socks5://",
+			wantServer: "tls://:443",
+			wantChain:  "socks5://",
+		},
+		{
+			// alpn's value contains a comma; it must not be mistaken for the
+			// server/chain separator.
+			in:         "tls://:443?alpn=h2,http/1.1,trojan://user@host;http://",
+			wantServer: "tls://:443?alpn=h2,http/1.1",
+			wantChain:  "trojan://user@host;http://",
+		},
+	}
+
+	for _, c := range cases {
+		server, chain := splitServerChain(c.in)
+		if server != c.wantServer || chain != c.wantChain {
+			t.Errorf("splitServerChain(%q) = (%q, %q), want (%q, %q)", c.in, server, chain, c.wantServer, c.wantChain)
+		}
+	}
+}
+
+func pipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	srvCh := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+		}
+		srvCh <- c
+	}()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	return client, <-srvCh
+}
+
+// generateTestCert returns a throwaway self-signed certificate for driving a
+// real TLS handshake in tests.
+func generateTestCert(t *testing.T) stdtls.Certificate {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	return stdtls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+// rejectAuth always fails, simulating a client presenting bad credentials.
+type rejectAuth struct{}
+
+func (rejectAuth) Authenticate(user, pass string) bool { return false }
+
+// fakeChainServer records whether Serve was ever invoked on it.
+type fakeChainServer struct{ served *bool }
+
+func (f *fakeChainServer) ListenAndServe() {}
+func (f *fakeChainServer) Addr() string    { return "fake" }
+func (f *fakeChainServer) Serve(c net.Conn) {
+	*f.served = true
+	c.Close()
+}
+
+// TestServeChecksAuthBeforeChainDispatch is a regression test for the
+// auth-bypass fixed in the "check auth before chain dispatch" commit: a
+// chained listener (here simulated via alpnChains) must reject a connection
+// that fails ?auth= before the matched chain server ever sees it.
+func TestServeChecksAuthBeforeChainDispatch(t *testing.T) {
+	cert := generateTestCert(t)
+
+	var served bool
+	s := &TLS{
+		auth:       rejectAuth{},
+		alpnChains: map[string]proxy.Server{"h2": &fakeChainServer{served: &served}},
+		config: &stdtls.Config{
+			Certificates: []stdtls.Certificate{cert},
+			NextProtos:   []string{"h2"},
+			MinVersion:   stdtls.VersionTLS12,
+		},
+	}
+
+	client, server := pipe(t)
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		cc := stdtls.Client(client, &stdtls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2"},
+		})
+		if err := cc.Handshake(); err != nil {
+			return
+		}
+		defer cc.Close()
+
+		frame := []byte("baduser\x00badpass")
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(frame)))
+		cc.Write(lenBuf)
+		cc.Write(frame)
+	}()
+
+	s.Serve(server)
+	<-done
+
+	if served {
+		t.Fatal("chain server was invoked despite failed auth")
+	}
+}